@@ -0,0 +1,157 @@
+package sshwrapper
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An Identity is a public key offered for authentication.
+type Identity struct {
+	PublicKey   ssh.PublicKey
+	Fingerprint string // SHA256 fingerprint as printed by ssh-add -l
+	Comment     string
+}
+
+// AgentIdentities returns the identities of the authentication agent listening on socket,
+// i.e. the keys Dial offers to the server, in the order they are offered.
+func AgentIdentities(socket string) ([]Identity, error) {
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer agentConn.Close()
+
+	keys, err := agent.NewClient(agentConn).List()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]Identity, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, Identity{
+			PublicKey:   k,
+			Fingerprint: ssh.FingerprintSHA256(k),
+			Comment:     k.Comment,
+		})
+	}
+	return ids, nil
+}
+
+// ErrNoAgent is returned by CheckAgent and ReconnectAgent for connections
+// without an authentication agent, e.g. those made by DialConfig.
+var ErrNoAgent = errors.New("connection has no authentication agent")
+
+// CheckAgent reports whether the authentication agent the connection forwards to still responds.
+// If it doesn't, e.g. because the agent was restarted, use ReconnectAgent.
+func (s *SSHConn) CheckAgent() error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	if s.fwdAgent == nil {
+		return ErrNoAgent
+	}
+	_, err := s.fwdAgent.List()
+	return err
+}
+
+// ReconnectAgent connects to the authentication agent listening on socket and forwards
+// to it from now on, without reestablishing the SSH connection.
+func (s *SSHConn) ReconnectAgent(socket string) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	if s.fwdAgent == nil {
+		return ErrNoAgent
+	}
+
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+
+	s.fwdAgent.set(agent.NewClient(agentConn))
+	s.agentConn.Close()
+	s.agentConn = agentConn
+	return nil
+}
+
+// CleanupAgentSockets removes the stale forwarded agent sockets of the remote user,
+// i.e. sockets left in /tmp/ssh-*/agent.<pid> by sshd processes that no longer run.
+// sshd normally removes them itself, but not in some sandboxed setups.
+//
+// The liveness of sshd processes is checked in /proc, so this works on Linux hosts only.
+func (s *SSHConn) CleanupAgentSockets() error {
+	script := `for sock in /tmp/ssh-*/agent.*; do
+	[ -S "$sock" ] && [ -O "$sock" ] || continue
+	[ "$sock" = "$SSH_AUTH_SOCK" ] && continue
+	[ -d "/proc/${sock##*.}" ] && continue
+	rm -f -- "$sock" && rmdir -- "${sock%/*}" 2>/dev/null
+done
+exit 0`
+	return s.runRaw(script, nil, nil, nil)
+}
+
+// agentProxy forwards agent requests to an agent that may be replaced.
+type agentProxy struct {
+	mu    sync.Mutex
+	agent agent.ExtendedAgent
+}
+
+func (p *agentProxy) get() agent.ExtendedAgent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.agent
+}
+
+func (p *agentProxy) set(a agent.ExtendedAgent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.agent = a
+}
+
+func (p *agentProxy) List() ([]*agent.Key, error) {
+	return p.get().List()
+}
+
+func (p *agentProxy) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return p.get().Sign(key, data)
+}
+
+func (p *agentProxy) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return p.get().SignWithFlags(key, data, flags)
+}
+
+func (p *agentProxy) Add(key agent.AddedKey) error {
+	return p.get().Add(key)
+}
+
+func (p *agentProxy) Remove(key ssh.PublicKey) error {
+	return p.get().Remove(key)
+}
+
+func (p *agentProxy) RemoveAll() error {
+	return p.get().RemoveAll()
+}
+
+func (p *agentProxy) Lock(passphrase []byte) error {
+	return p.get().Lock(passphrase)
+}
+
+func (p *agentProxy) Unlock(passphrase []byte) error {
+	return p.get().Unlock(passphrase)
+}
+
+func (p *agentProxy) Signers() ([]ssh.Signer, error) {
+	return p.get().Signers()
+}
+
+func (p *agentProxy) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return p.get().Extension(extensionType, contents)
+}
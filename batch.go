@@ -0,0 +1,50 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"sync"
+)
+
+// MaxBatchSessions specifies the maximum number of sessions RunBatch opens at once.
+// It matches the default MaxSessions of OpenSSH.
+var MaxBatchSessions = 10
+
+// A Result is the outcome of a command run by RunBatch.
+type Result struct {
+	Cmd    string
+	Stdout []byte
+	Stderr []byte
+	Err    error
+}
+
+// RunBatch runs cmds concurrently over the connection, at most MaxBatchSessions at a time
+// minus the sessions the connection keeps open, and returns their results in the order of cmds.
+func (s *SSHConn) RunBatch(cmds []string) []Result {
+	n := MaxBatchSessions - s.heldSessions
+	if n <= 0 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+
+	results := make([]Result, len(cmds))
+	var wg sync.WaitGroup
+	for i, cmd := range cmds {
+		wg.Add(1)
+		go func(i int, cmd string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var stdout, stderr bytes.Buffer
+			err := s.Run(cmd, nil, &stdout, &stderr)
+			results[i] = Result{
+				Cmd:    cmd,
+				Stdout: stdout.Bytes(),
+				Stderr: stderr.Bytes(),
+				Err:    err,
+			}
+		}(i, cmd)
+	}
+	wg.Wait()
+	return results
+}
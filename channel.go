@@ -0,0 +1,118 @@
+package sshwrapper
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionChannel exposes stdio of a session as an io.ReadWriteCloser.
+type sessionChannel struct {
+	io.Reader
+	stdin   io.WriteCloser
+	session *ssh.Session
+}
+
+func newSessionChannel(session *ssh.Session) (*sessionChannel, error) {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionChannel{
+		Reader:  stdout,
+		stdin:   stdin,
+		session: session,
+	}, nil
+}
+
+func (c *sessionChannel) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close closes the input and the underlying session.
+func (c *sessionChannel) Close() error {
+	c.stdin.Close()
+	return c.session.Close()
+}
+
+// Subsystem opens a session, requests the named subsystem (e.g. "netconf")
+// and returns the channel for talking to it.
+//
+// Variables set to empty values by SetEnvs are sent like the others,
+// which fails if the server rejects them.
+//
+// Closing the returned channel closes the session.
+func (s *SSHConn) Subsystem(name string) (io.ReadWriteCloser, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, ErrEmptyCommand
+	}
+
+	session, err := s.newSession(true)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := newSessionChannel(session)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.RequestSubsystem(name); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// A Console is a connection whose only purpose is to run a single fixed command
+// and talk to it over its stdio, as restricted-shell appliances require.
+type Console struct {
+	*sessionChannel
+	conn *SSHConn
+}
+
+// DialConsole connects to the given SSH server like Dial and starts cmd on it.
+// All further interaction happens by reading from and writing to the returned Console.
+func DialConsole(addr string, socket string, forwardAgent bool, cmd string) (*Console, error) {
+	if strings.TrimSpace(cmd) == "" {
+		return nil, ErrEmptyCommand
+	}
+
+	conn, err := Dial(addr, socket, forwardAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.newSession(true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ch, err := newSessionChannel(session)
+	if err != nil {
+		session.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &Console{sessionChannel: ch, conn: conn}, nil
+}
+
+// Close closes the console's session and connection.
+func (c *Console) Close() error {
+	err := c.sessionChannel.Close()
+	c.conn.Close()
+	return err
+}
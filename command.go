@@ -0,0 +1,245 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Command is a command running on the remote host.
+type Command struct {
+	session *ssh.Session
+	ctx     context.Context
+	done    chan struct{}
+	err     error
+}
+
+// Start starts cmd on the remote host but does not wait for it to complete.
+//
+// If ctx is done before the command completes, the command is sent SIGKILL
+// and its session is closed. Servers may ignore the signal, and closing the session
+// doesn't terminate a command running without a terminal, so it may keep running
+// on the remote host.
+//
+// in is copied to the command concurrently with its output, so writing all input
+// before reading any output doesn't deadlock. To feed input incrementally, pass the
+// reading end of an io.Pipe and close the writing end to send EOF to the command.
+func (s *SSHConn) Start(ctx context.Context, cmd string, in io.Reader, outWriter, errWriter io.Writer) (*Command, error) {
+	if strings.TrimSpace(cmd) == "" {
+		return nil, ErrEmptyCommand
+	}
+
+	session, err := s.newSession(false)
+	if err != nil {
+		return nil, s.withID(err)
+	}
+
+	errWriter, tail := s.teeStderr(errWriter)
+	guard := s.newOutputGuard(session)
+	session.Stdout = guard.wrap(outWriter, "stdout")
+	session.Stderr = guard.wrap(errWriter, "stderr")
+	cmd, session.Stdin = s.prepareCommand(cmd, in)
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, s.withID(err)
+	}
+
+	cmdCtx, cancel := context.WithCancel(ctx)
+	c := &Command{
+		session: session,
+		ctx:     cmdCtx,
+		done:    make(chan struct{}),
+	}
+
+	killed := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(killed)
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-c.done:
+		}
+	}()
+
+	go func() {
+		err := session.Wait()
+		session.Close()
+		if err != nil {
+			select {
+			case <-killed:
+				err = ctx.Err()
+			default:
+			}
+		}
+		c.err = s.classifyExit(s.withID(withStderr(guard.check(signalError(err)), tail)))
+		close(c.done)
+		cancel()
+	}()
+
+	return c, nil
+}
+
+// PipeCombined starts cmd on the remote host and returns a reader over its interleaved
+// standard output and standard error. The reader returns io.EOF once the command completes;
+// use the returned Command to learn its result.
+//
+// Closing the reader before the end of the output aborts the command.
+func (s *SSHConn) PipeCombined(cmd string, in io.Reader) (io.ReadCloser, *Command, error) {
+	pr, pw := io.Pipe()
+	c, err := s.Start(context.Background(), cmd, in, pw, pw)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		c.Wait()
+		pw.Close()
+	}()
+	return pr, c, nil
+}
+
+// Wait waits for the command to complete and returns its error.
+//
+// If the command failed after the context passed to Start was done,
+// the context's error is returned.
+func (c *Command) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Context returns a context that is cancelled when the command completes.
+// It is derived from the context passed to Start.
+func (c *Command) Context() context.Context {
+	return c.ctx
+}
+
+// Transform runs cmd on the remote host with input as its standard input
+// and returns its standard output, e.g. for formatters reading all input before writing.
+func (s *SSHConn) Transform(cmd string, input []byte) ([]byte, error) {
+	return s.Output(cmd, bytes.NewReader(input))
+}
+
+// RunFrom runs cmd on the remote host like Run, streaming r into its standard input,
+// e.g. a local dump piped into `cat > dump`. It returns the exit code of the command,
+// regardless of the exit code classifier.
+func (s *SSHConn) RunFrom(cmd string, r io.Reader, outWriter, errWriter io.Writer) (int, error) {
+	return exitCode(s.runRaw(cmd, r, outWriter, errWriter))
+}
+
+// RunFromLocal runs local on this host and cmd on the remote host with the standard output
+// of local piped into the standard input of cmd, like `local | ssh host cmd`.
+// It returns the exit code of the remote command; a failure of local is returned as an error.
+//
+// As in a shell pipeline, if cmd exits without reading all of its input, local gets
+// SIGPIPE (or EPIPE) on its next write, which is then reported as its failure.
+func (s *SSHConn) RunFromLocal(cmd string, local *exec.Cmd, outWriter, errWriter io.Writer) (int, error) {
+	pipe, err := local.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	if err := local.Start(); err != nil {
+		return -1, err
+	}
+
+	code, err := s.RunFrom(cmd, pipe, outWriter, errWriter)
+	// nobody reads the output of local any more, close the pipe so that
+	// local doesn't block writing to it forever
+	pipe.Close()
+	if err != nil {
+		local.Process.Kill()
+	}
+	if lerr := local.Wait(); lerr != nil && err == nil {
+		err = fmt.Errorf("local command: %w", lerr)
+	}
+	return code, err
+}
+
+// RunDetached launches cmd on the remote host in the background, detached from the session
+// so that it survives the session closing, and returns as soon as it is launched.
+// The command's output is discarded.
+func (s *SSHConn) RunDetached(cmd string) error {
+	wrapped := `nohup "${SHELL:-/bin/sh}" -c ` + shellQuote(cmd) + ` </dev/null >/dev/null 2>&1 &`
+	return s.runRaw(wrapped, nil, nil, nil)
+}
+
+// exitCode returns the exit code of a command that ran to completion.
+// Errors other than a non-zero exit are returned as is.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var sigErr *SignalError
+	if errors.As(err, &sigErr) {
+		return -1, err
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	return -1, err
+}
+
+// SetExitCodeClassifier makes commands whose non-zero exit code satisfies ok
+// complete without an error, e.g. for tools exiting with 1 for "already converged".
+// A nil classifier restores the default of treating any non-zero exit code as failure.
+//
+// Helpers interpreting the exit codes of their own commands, such as DeployFile
+// or RunToFile, are not affected.
+func (s *SSHConn) SetExitCodeClassifier(ok func(code int) bool) {
+	s.exitOK = ok
+}
+
+// classifyExit drops the exit error if the exit code is considered a success.
+//
+// It is applied by the methods running the caller's commands only; helpers
+// running commands of their own use runRaw and outputRaw instead.
+func (s *SSHConn) classifyExit(err error) error {
+	if s.exitOK == nil {
+		return err
+	}
+	var e *ssh.ExitError
+	if errors.As(err, &e) && e.Signal() == "" && s.exitOK(e.ExitStatus()) {
+		return nil
+	}
+	return err
+}
+
+// A SignalError is returned when the remote command was terminated by a signal.
+type SignalError struct {
+	Signal       string // signal name without the SIG prefix, e.g. "KILL"
+	ErrorMessage string
+
+	exitErr *ssh.ExitError
+}
+
+func (e *SignalError) Error() string {
+	msg := fmt.Sprintf("remote command killed by signal %s", e.Signal)
+	if e.ErrorMessage != "" {
+		msg += ": " + e.ErrorMessage
+	}
+	return msg
+}
+
+// Unwrap returns the underlying *ssh.ExitError.
+func (e *SignalError) Unwrap() error {
+	return e.exitErr
+}
+
+// signalError converts the exit error of a command terminated by a signal into a *SignalError.
+func signalError(err error) error {
+	e, ok := err.(*ssh.ExitError)
+	if !ok || e.Signal() == "" {
+		return err
+	}
+	return &SignalError{
+		Signal:       e.Signal(),
+		ErrorMessage: e.Msg(),
+		exitErr:      e,
+	}
+}
@@ -0,0 +1,198 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dirEntry describes an entry of a directory tree compared by DiffDir.
+type dirEntry struct {
+	kind   byte // 'f' for regular files, 'd' for directories, 'l' for symbolic links
+	size   int64
+	target string
+}
+
+// DiffDir compares the local directory tree localDir with the remote tree remoteDir
+// and returns the slash-separated paths, relative to the trees' roots, of the entries
+// present only locally, only remotely, and present in both but differing.
+//
+// Directories are entries themselves: a directory present on one side only is reported
+// along with all of its contents. Regular files differ if their sizes differ, symbolic links
+// if their targets differ; links are never followed. An entry whose type differs between
+// the sides, e.g. a file replaced by a directory, is reported as differing.
+// Other file types are ignored.
+//
+// The remote tree is listed with GNU find.
+func (s *SSHConn) DiffDir(localDir, remoteDir string) (onlyLocal, onlyRemote, differing []string, err error) {
+	return s.diffDir(localDir, remoteDir, false)
+}
+
+// DiffDirChecksum is like DiffDir but additionally compares the SHA-256 checksums
+// of regular files of the same size.
+func (s *SSHConn) DiffDirChecksum(localDir, remoteDir string) (onlyLocal, onlyRemote, differing []string, err error) {
+	return s.diffDir(localDir, remoteDir, true)
+}
+
+func (s *SSHConn) diffDir(localDir, remoteDir string, checksum bool) (onlyLocal, onlyRemote, differing []string, err error) {
+	local, err := localTree(localDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remote, err := s.remoteTree(remoteDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var sameSize []string
+	for p, l := range local {
+		r, ok := remote[p]
+		switch {
+		case !ok:
+			onlyLocal = append(onlyLocal, p)
+		case l.kind != r.kind:
+			differing = append(differing, p)
+		case l.kind == 'f' && l.size != r.size:
+			differing = append(differing, p)
+		case l.kind == 'f' && checksum:
+			sameSize = append(sameSize, p)
+		case l.kind == 'l' && l.target != r.target:
+			differing = append(differing, p)
+		}
+	}
+	for p := range remote {
+		if _, ok := local[p]; !ok {
+			onlyRemote = append(onlyRemote, p)
+		}
+	}
+
+	if len(sameSize) > 0 {
+		sums, err := s.remoteChecksums(remoteDir, sameSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, p := range sameSize {
+			sum, err := fileChecksum(filepath.Join(localDir, filepath.FromSlash(p)))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if sum != sums[p] {
+				differing = append(differing, p)
+			}
+		}
+	}
+
+	sort.Strings(onlyLocal)
+	sort.Strings(onlyRemote)
+	sort.Strings(differing)
+	return onlyLocal, onlyRemote, differing, nil
+}
+
+// localTree lists the entries of the local tree rooted at dir.
+func localTree(dir string) (map[string]dirEntry, error) {
+	tree := make(map[string]dirEntry)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch t := d.Type(); {
+		case t.IsDir():
+			tree[rel] = dirEntry{kind: 'd'}
+		case t.IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			tree[rel] = dirEntry{kind: 'f', size: info.Size()}
+		case t&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = dirEntry{kind: 'l', target: target}
+		}
+		return nil
+	})
+	return tree, err
+}
+
+// remoteTree lists the entries of the remote tree rooted at dir.
+func (s *SSHConn) remoteTree(dir string) (map[string]dirEntry, error) {
+	out, err := s.outputRaw(`find `+shellQuote(dir)+` -mindepth 1 -printf '%y\0%s\0%P\0%l\0'`, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bytes.Split(out, []byte{0})
+	// output ends with a NUL, so there is an empty last field
+	if len(fields)%4 != 1 {
+		return nil, fmt.Errorf("unexpected find output")
+	}
+	tree := make(map[string]dirEntry)
+	for i := 0; i+4 <= len(fields); i += 4 {
+		kind, path := string(fields[i]), string(fields[i+2])
+		switch kind {
+		case "d":
+			tree[path] = dirEntry{kind: 'd'}
+		case "f":
+			size, err := strconv.ParseInt(string(fields[i+1]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected find output: %v", err)
+			}
+			tree[path] = dirEntry{kind: 'f', size: size}
+		case "l":
+			tree[path] = dirEntry{kind: 'l', target: string(fields[i+3])}
+		}
+	}
+	return tree, nil
+}
+
+// remoteChecksums returns the SHA-256 checksums of the given files of the remote tree rooted at dir.
+func (s *SSHConn) remoteChecksums(dir string, paths []string) (map[string]string, error) {
+	// the paths are passed on stdin as the command line would overflow ARG_MAX for large trees
+	in := strings.NewReader(strings.Join(paths, "\x00"))
+	out, err := s.outputRaw("cd "+shellQuote(dir)+" && xargs -0 -r sha256sum -z --", in)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\x00") {
+		if sum, path, ok := strings.Cut(line, "  "); ok {
+			sums[path] = sum
+		}
+	}
+	return sums, nil
+}
+
+// fileChecksum returns the hex SHA-256 checksum of a local file.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,52 @@
+package sshwrapper
+
+import (
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// commonEnvNames lists the variables AcceptedEnv probes in addition to those set with SetEnvs.
+var commonEnvNames = []string{
+	"LANG", "LANGUAGE", "LC_ALL", "LC_CTYPE", "LC_MESSAGES", "LC_NUMERIC", "LC_TIME", "LC_COLLATE", "TZ",
+}
+
+// AcceptedEnv probes which environment variables the server accepts with "env" requests,
+// i.e. allows by its AcceptEnv setting. It checks the variables set with SetEnvs
+// and common locale variables, and returns the accepted names sorted.
+func (s *SSHConn) AcceptedEnv() ([]string, error) {
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	names := make(map[string]bool)
+	for _, k := range commonEnvNames {
+		names[k] = true
+	}
+	for k := range s.envs {
+		names[k] = true
+	}
+
+	var accepted []string
+	for k := range names {
+		req := struct {
+			Name  string
+			Value string
+		}{k, "probe"}
+		ok, err := session.SendRequest("env", true, ssh.Marshal(&req))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			accepted = append(accepted, k)
+		}
+	}
+	sort.Strings(accepted)
+	return accepted, nil
+}
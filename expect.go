@@ -0,0 +1,161 @@
+package sshwrapper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A ConnectStep is a step of the interaction performed by DialOnConnect over the initial session.
+type ConnectStep struct {
+	// Expect, if set, makes the step wait for output matching it, e.g. a menu prompt.
+	Expect *regexp.Regexp
+	// Send, if set, is written to the session once Expect matched, e.g. "2\n".
+	Send string
+}
+
+// OnConnectTimeout specifies the maximum amount of time to wait for each Expect of DialOnConnect.
+var OnConnectTimeout = 30 * time.Second
+
+// DialOnConnect is like Dial but performs steps over an interactive shell session
+// right after connecting, e.g. to pick a target host from a bastion's menu.
+//
+// The session stays open for the lifetime of the connection and counts against
+// the server's MaxSessions, so RunBatch opens one session less at a time.
+func DialOnConnect(addr string, socket string, forwardAgent bool, steps []ConnectStep) (*SSHConn, error) {
+	return dial(addr, socket, forwardAgent, nil, steps)
+}
+
+// interact opens an interactive shell session on client and performs steps over it.
+func interact(client *ssh.Client, steps []ConnectStep) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	var ok bool
+	defer func() {
+		if !ok {
+			session.Close()
+		}
+	}()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}); err != nil {
+		return err
+	}
+	if err := session.Shell(); err != nil {
+		return err
+	}
+
+	e := newExpecter(stdout)
+	defer func() {
+		if !ok {
+			go e.discard()
+		}
+	}()
+	for _, step := range steps {
+		if step.Expect != nil {
+			if err := e.expect(step.Expect, OnConnectTimeout); err != nil {
+				return err
+			}
+		}
+		if step.Send != "" {
+			if _, err := io.WriteString(stdin, step.Send); err != nil {
+				return err
+			}
+		}
+	}
+	// the session stays alive, its further output is discarded
+	go e.discard()
+
+	ok = true
+	return nil
+}
+
+// Expect runs cmd on the remote host and waits until its combined standard output
+// and standard error match pattern. It fails if the command completes or timeout
+// elapses without a match. The command is killed once Expect returns.
+func (s *SSHConn) Expect(cmd string, pattern *regexp.Regexp, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	c, err := s.Start(ctx, cmd, nil, pw, pw)
+	if err != nil {
+		return err
+	}
+	go func() {
+		c.Wait()
+		pw.Close()
+	}()
+
+	e := newExpecter(pr)
+	defer func() {
+		pr.Close()
+		go e.discard()
+	}()
+	return e.expect(pattern, timeout)
+}
+
+// expecter waits for patterns in the output of a reader.
+type expecter struct {
+	chunks <-chan []byte
+	buf    []byte
+}
+
+func newExpecter(r io.Reader) *expecter {
+	chunks := make(chan []byte)
+	go func() {
+		defer close(chunks)
+		for {
+			b := make([]byte, 4096)
+			n, err := r.Read(b)
+			if n > 0 {
+				chunks <- b[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &expecter{chunks: chunks}
+}
+
+// expect consumes the output up to and including the first match of re.
+func (e *expecter) expect(re *regexp.Regexp, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if loc := re.FindIndex(e.buf); loc != nil {
+			e.buf = e.buf[loc[1]:]
+			return nil
+		}
+		select {
+		case b, ok := <-e.chunks:
+			if !ok {
+				return fmt.Errorf("output closed before %q matched", re)
+			}
+			e.buf = append(e.buf, b...)
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for %q", re)
+		}
+	}
+}
+
+// discard drops the rest of the output.
+func (e *expecter) discard() {
+	for range e.chunks {
+	}
+}
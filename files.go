@@ -0,0 +1,311 @@
+package sshwrapper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeployFile atomically replaces remotePath with the contents of localPath.
+//
+// The file is uploaded to a temporary file next to remotePath, its checksum is verified,
+// and only then it is renamed into place, so remotePath never contains a partially written file.
+func (s *SSHConn) DeployFile(localPath, remotePath string, mode os.FileMode) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmpPath, err := tempPath(remotePath)
+	if err != nil {
+		return err
+	}
+
+	s.trackTempFile(tmpPath)
+	var ok bool
+	defer func() {
+		if ok {
+			s.untrackTempFile(tmpPath)
+			return
+		}
+		if s.runRaw("rm -f -- "+shellQuote(tmpPath), nil, nil, nil) == nil {
+			s.untrackTempFile(tmpPath)
+		}
+	}()
+
+	h := sha256.New()
+	if err := s.runRaw("cat > "+shellQuote(tmpPath), io.TeeReader(f, h), nil, nil); err != nil {
+		return err
+	}
+
+	sum, err := s.RemoteChecksum(tmpPath, "sha256")
+	if err != nil {
+		return err
+	}
+	if sum != hex.EncodeToString(h.Sum(nil)) {
+		return fmt.Errorf("checksum mismatch for %s", tmpPath)
+	}
+
+	cmd := fmt.Sprintf("chmod %o %s && mv -f -- %s %s", mode.Perm(), shellQuote(tmpPath), shellQuote(tmpPath), shellQuote(remotePath))
+	if err := s.runRaw(cmd, nil, nil, nil); err != nil {
+		return err
+	}
+
+	ok = true
+	return nil
+}
+
+// checksumCommands maps the algorithms supported by RemoteChecksum to the remote tools computing them.
+var checksumCommands = map[string]string{
+	"md5":    "md5sum",
+	"sha1":   "sha1sum",
+	"sha224": "sha224sum",
+	"sha256": "sha256sum",
+	"sha384": "sha384sum",
+	"sha512": "sha512sum",
+}
+
+// RemoteChecksum computes the checksum of remotePath on the remote host and returns its hex digest.
+// algo is one of md5, sha1, sha224, sha256, sha384 and sha512.
+func (s *SSHConn) RemoteChecksum(remotePath, algo string) (string, error) {
+	tool, ok := checksumCommands[algo]
+	if !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+
+	out, err := s.outputRaw(tool+" -- "+shellQuote(remotePath), nil)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected %s output: %q", tool, out)
+	}
+	// file names with special characters make the digest start with a backslash
+	sum := strings.TrimPrefix(fields[0], "\\")
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("unexpected %s output: %q", tool, out)
+	}
+	return sum, nil
+}
+
+// CloseCleanupTimeout bounds the time Close spends removing remote temporary files,
+// as they are usually left behind because the connection broke. Zero disables the removal.
+var CloseCleanupTimeout = 5 * time.Second
+
+// Cleanup removes the remote temporary files left behind by failed helpers such as DeployFile.
+// It is also called by Close on a best-effort basis, see CloseCleanupTimeout. It must not be
+// called while such helpers are running, as it would remove their files in use.
+func (s *SSHConn) Cleanup() error {
+	s.mu.Lock()
+	paths := make([]string, 0, len(s.tempFiles))
+	for p := range s.tempFiles {
+		paths = append(paths, shellQuote(p))
+	}
+	s.mu.Unlock()
+
+	if len(paths) == 0 {
+		return nil
+	}
+	if err := s.runRaw("rm -f -- "+strings.Join(paths, " "), nil, nil, nil); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tempFiles = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// cleanupOnClose runs Cleanup for Close, giving up after CloseCleanupTimeout.
+// Closing the connection then aborts the abandoned cleanup.
+func (s *SSHConn) cleanupOnClose() {
+	s.mu.Lock()
+	pending := len(s.tempFiles)
+	s.mu.Unlock()
+	if pending == 0 || CloseCleanupTimeout <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Cleanup()
+		close(done)
+	}()
+	timer := time.NewTimer(CloseCleanupTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+func (s *SSHConn) trackTempFile(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tempFiles == nil {
+		s.tempFiles = make(map[string]bool)
+	}
+	s.tempFiles[path] = true
+}
+
+func (s *SSHConn) untrackTempFile(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tempFiles, path)
+}
+
+// tempPath returns a random path in the same directory as path.
+func tempPath(path string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path + ".tmp." + hex.EncodeToString(b), nil
+}
+
+// HomeDir returns the home directory of the remote user.
+// The result is cached for the lifetime of the connection.
+func (s *SSHConn) HomeDir() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.homeDir != "" {
+		return s.homeDir, nil
+	}
+
+	out, err := s.outputRaw(`echo "$HOME"`, nil)
+	if err != nil {
+		return "", err
+	}
+	home := strings.TrimSpace(string(out))
+	if home == "" {
+		return "", fmt.Errorf("remote home directory is not set")
+	}
+	s.homeDir = home
+	return home, nil
+}
+
+// RunToFile runs cmd on the remote host with its standard output and standard error
+// redirected to remotePath, so that the output stays on the remote host.
+// If remotePath is empty, a temporary file is created with mktemp.
+//
+// It returns the path of the output file and the exit code of the command.
+// If the output file can't be created, cmd is not run and an error is returned.
+func (s *SSHConn) RunToFile(cmd string, remotePath string, in io.Reader) (string, int, error) {
+	script := "f=" + shellQuote(remotePath)
+	if remotePath == "" {
+		script = "f=$(mktemp) || exit 1"
+	}
+	// the path is printed only once the file is known to be writable, so that a failure
+	// to open it is not mistaken for the exit code of cmd
+	script += "; true > \"$f\" || exit 1; echo \"$f\"; {\n" + cmd + "\n} > \"$f\" 2>&1"
+
+	out, err := s.outputRaw(script, in)
+	code, err := exitCode(err)
+	if err != nil {
+		return "", code, err
+	}
+
+	path := strings.TrimSuffix(string(out), "\n")
+	if path == "" {
+		if remotePath == "" {
+			return "", -1, fmt.Errorf("failed to create remote output file")
+		}
+		return "", -1, fmt.Errorf("failed to open remote output file %s", remotePath)
+	}
+	return path, code, nil
+}
+
+// DiskFree returns the number of bytes available to the remote user
+// on the filesystem containing path.
+func (s *SSHConn) DiskFree(path string) (int64, error) {
+	out, err := s.outputRaw("df -kP -- "+shellQuote(path), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Filesystem 1024-blocks Used Available Capacity Mounted on
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	return kb * 1024, nil
+}
+
+// Readlink returns the target of the symbolic link remotePath.
+//
+// There is no SFTP support in this package, so it runs readlink on the remote host.
+func (s *SSHConn) Readlink(remotePath string) (string, error) {
+	return s.outputPath("readlink -- " + shellQuote(remotePath))
+}
+
+// RealPath returns the canonical absolute path of remotePath with all symbolic links resolved.
+//
+// There is no SFTP support in this package, so it runs readlink -f on the remote host.
+func (s *SSHConn) RealPath(remotePath string) (string, error) {
+	return s.outputPath("readlink -f -- " + shellQuote(remotePath))
+}
+
+// outputPath runs cmd and returns the single path it prints.
+func (s *SSHConn) outputPath(cmd string) (string, error) {
+	out, err := s.outputRaw(cmd, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// IsWritable reports whether the remote user can write remotePath,
+// or create it in its directory if it doesn't exist.
+func (s *SSHConn) IsWritable(remotePath string) (bool, error) {
+	cmd := "p=" + shellQuote(remotePath) + `; [ -e "$p" ] || p=$(dirname -- "$p"); test -w "$p"`
+	code, err := exitCode(s.runRaw(cmd, nil, nil, nil))
+	if err != nil {
+		return false, err
+	}
+	return code == 0, nil
+}
+
+// Head returns the first n lines of remotePath without transferring the rest of the file.
+func (s *SSHConn) Head(remotePath string, n int) ([]string, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("negative line count: %d", n)
+	}
+	return s.fileLines(fmt.Sprintf("head -n %d -- %s", n, shellQuote(remotePath)))
+}
+
+// Tail returns the last n lines of remotePath without transferring the rest of the file.
+func (s *SSHConn) Tail(remotePath string, n int) ([]string, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("negative line count: %d", n)
+	}
+	return s.fileLines(fmt.Sprintf("tail -n %d -- %s", n, shellQuote(remotePath)))
+}
+
+// fileLines runs cmd and returns its output split into lines without line terminators.
+func (s *SSHConn) fileLines(cmd string) ([]string, error) {
+	out, err := s.outputRaw(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
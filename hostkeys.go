@@ -0,0 +1,154 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A HostKeyStore stores the known public keys of SSH servers.
+// Hosts are given as "host:port", like the address passed to ssh.Dial.
+type HostKeyStore interface {
+	// Lookup returns the known keys of host. No keys and no error mean the host is unknown.
+	Lookup(host string) ([]ssh.PublicKey, error)
+	// Add records key as a known key of host.
+	Add(host string, key ssh.PublicKey) error
+}
+
+// HostKeys specifies the store Dial verifies server host keys against.
+// If nil, host keys are not verified.
+var HostKeys HostKeyStore
+
+// AcceptNewHostKeys makes Dial add the keys of hosts unknown to HostKeys to the store
+// instead of failing with ErrUnknownHost (trust on first use).
+var AcceptNewHostKeys = false
+
+var (
+	// ErrUnknownHost is returned by Dial when HostKeys has no keys for the server.
+	ErrUnknownHost = errors.New("unknown host")
+	// ErrHostKeyMismatch is returned by Dial when the server's key is not among its known keys.
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+)
+
+// hostKeyCallback returns the callback verifying host keys against HostKeys.
+func hostKeyCallback() ssh.HostKeyCallback {
+	store := HostKeys
+	if store == nil {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		known, err := store.Lookup(hostname)
+		if err != nil {
+			return err
+		}
+		if len(known) == 0 {
+			if AcceptNewHostKeys {
+				return store.Add(hostname, key)
+			}
+			return fmt.Errorf("%w: %s", ErrUnknownHost, hostname)
+		}
+		for _, k := range known {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrHostKeyMismatch, hostname)
+	}
+}
+
+// hostKeyAlgorithms returns the host key algorithms to offer when connecting to hostport:
+// those of the keys HostKeys knows for it, so that the server doesn't present a key
+// of another type that would be reported as a mismatch. Nil means the defaults.
+func hostKeyAlgorithms(hostport string) ([]string, error) {
+	if HostKeys == nil {
+		return nil, nil
+	}
+	known, err := HostKeys.Lookup(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	var algos []string
+	seen := make(map[string]bool)
+	for _, k := range known {
+		names := []string{k.Type()}
+		if k.Type() == ssh.KeyAlgoRSA {
+			// RSA keys are used with SHA-2 signatures by modern servers
+			names = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range names {
+			if !seen[a] {
+				seen[a] = true
+				algos = append(algos, a)
+			}
+		}
+	}
+	return algos, nil
+}
+
+// KnownHostsStore returns a HostKeyStore backed by an OpenSSH known_hosts file.
+// Lookup understands hashed and wildcard entries; Add appends plain entries
+// and creates the file if needed.
+func KnownHostsStore(path string) HostKeyStore {
+	return &knownHostsStore{path: path}
+}
+
+type knownHostsStore struct {
+	path string
+}
+
+func (k *knownHostsStore) Lookup(host string) ([]ssh.PublicKey, error) {
+	callback, err := knownhosts.New(k.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The knownhosts package has no lookup; a key that never matches
+	// makes the callback report all known keys of the host instead.
+	err = callback(host, lookupAddr(host), lookupKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil, err
+	}
+	keys := make([]ssh.PublicKey, 0, len(keyErr.Want))
+	for _, want := range keyErr.Want {
+		keys = append(keys, want.Key)
+	}
+	return keys, nil
+}
+
+func (k *knownHostsStore) Add(host string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(host)}, key) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// lookupAddr is the remote address passed to the knownhosts callback on lookup.
+type lookupAddr string
+
+func (a lookupAddr) Network() string { return "tcp" }
+func (a lookupAddr) String() string  { return string(a) }
+
+// lookupKey is a public key not matching any known key.
+type lookupKey struct{}
+
+func (lookupKey) Type() string    { return "sshwrapper-lookup" }
+func (lookupKey) Marshal() []byte { return []byte("sshwrapper-lookup") }
+func (lookupKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("lookup key can't verify")
+}
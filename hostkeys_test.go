@@ -0,0 +1,163 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newEd25519Key(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sameKeys(got, want []ssh.PublicKey) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !bytes.Equal(got[i].Marshal(), want[i].Marshal()) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKnownHostsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	store := KnownHostsStore(path)
+
+	if keys, err := store.Lookup("example.com:22"); err != nil || len(keys) != 0 {
+		t.Fatalf("Lookup without a file = %v, %v, want no keys", keys, err)
+	}
+
+	key22 := newEd25519Key(t)
+	key2222 := newEd25519Key(t)
+	if err := store.Add("example.com:22", key22); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("example.com:2222", key2222); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries written by OpenSSH with HashKnownHosts enabled
+	hashedKey := newEd25519Key(t)
+	hashed := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize("hashed.example.com:2200"))}, hashedKey)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(hashed + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tests := []struct {
+		host string
+		want []ssh.PublicKey
+	}{
+		{host: "example.com:22", want: []ssh.PublicKey{key22}},
+		{host: "example.com:2222", want: []ssh.PublicKey{key2222}},
+		{host: "example.com:2200", want: nil},
+		{host: "other.example.com:22", want: nil},
+		{host: "hashed.example.com:2200", want: []ssh.PublicKey{hashedKey}},
+		{host: "hashed.example.com:22", want: nil},
+	}
+	for _, tt := range tests {
+		keys, err := store.Lookup(tt.host)
+		if err != nil {
+			t.Errorf("Lookup(%q): %v", tt.host, err)
+			continue
+		}
+		if !sameKeys(keys, tt.want) {
+			t.Errorf("Lookup(%q) returned %d keys, want %d", tt.host, len(keys), len(tt.want))
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("[example.com]:2222 ")) {
+		t.Errorf("Add didn't write the non-22 port in OpenSSH format:\n%s", data)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	defer func(store HostKeyStore) { HostKeys = store }(HostKeys)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPub, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	HostKeys = KnownHostsStore(filepath.Join(t.TempDir(), "known_hosts"))
+	for _, k := range []ssh.PublicKey{newEd25519Key(t), rsaPub} {
+		if err := HostKeys.Add("example.com:22", k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := HostKeys.Add("ecdsa.example.com:2222", ecdsaPub); err != nil {
+		t.Fatal(err)
+	}
+
+	algos, err := hostKeyAlgorithms("example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		ssh.KeyAlgoED25519:   true,
+		ssh.KeyAlgoRSASHA512: true,
+		ssh.KeyAlgoRSASHA256: true,
+		ssh.KeyAlgoRSA:       true,
+	}
+	got := make(map[string]bool)
+	for _, a := range algos {
+		got[a] = true
+	}
+	if len(algos) != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("hostKeyAlgorithms(example.com:22) = %q", algos)
+	}
+
+	if algos, err := hostKeyAlgorithms("ecdsa.example.com:2222"); err != nil || !reflect.DeepEqual(algos, []string{ssh.KeyAlgoECDSA256}) {
+		t.Errorf("hostKeyAlgorithms(ecdsa.example.com:2222) = %q, %v", algos, err)
+	}
+	if algos, err := hostKeyAlgorithms("unknown.example.com:22"); err != nil || algos != nil {
+		t.Errorf("hostKeyAlgorithms(unknown host) = %q, %v, want the defaults", algos, err)
+	}
+
+	HostKeys = nil
+	if algos, err := hostKeyAlgorithms("example.com:22"); err != nil || algos != nil {
+		t.Errorf("hostKeyAlgorithms without HostKeys = %q, %v, want the defaults", algos, err)
+	}
+}
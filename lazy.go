@@ -0,0 +1,41 @@
+package sshwrapper
+
+import "errors"
+
+// DialLazy is like Dial but defers connecting to the server until the connection is first used.
+// Only the address is validated up front; errors of the deferred dial are returned
+// by the method that triggered it, and the next use tries to connect again.
+func DialLazy(addr string, socket string, forwardAgent bool) (*SSHConn, error) {
+	if _, _, _, err := ParseAddr(addr); err != nil {
+		return nil, err
+	}
+
+	c := SSHConn{
+		forwardAgent: forwardAgent,
+		dial: func() (*SSHConn, error) {
+			return Dial(addr, socket, forwardAgent)
+		},
+	}
+	return &c, nil
+}
+
+// connect establishes a lazy connection if it hasn't been established yet.
+func (s *SSHConn) connect() error {
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+
+	if s.client != nil {
+		return nil
+	}
+	if s.dial == nil {
+		return errors.New("connection closed")
+	}
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	s.client = c.client
+	s.agentConn = c.agentConn
+	s.fwdAgent = c.fwdAgent
+	return nil
+}
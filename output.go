@@ -0,0 +1,237 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/encoding"
+)
+
+// ErrOutputTooLarge is returned when a command produces more output than allowed by SetMaxOutput.
+var ErrOutputTooLarge = errors.New("command output too large")
+
+// SetMaxOutput limits the total number of bytes of standard output and standard error
+// a single command may produce. Once the limit is exceeded the command's session is closed
+// and ErrOutputTooLarge is returned. Zero means no limit.
+func (s *SSHConn) SetMaxOutput(n int64) {
+	s.maxOutput = n
+}
+
+// SetOutputEncoding makes Output and CombinedOutput convert the command output
+// from enc to UTF-8, e.g. charmap.ISO8859_1 or japanese.ShiftJIS for legacy hosts.
+// A nil encoding returns the output as is. Helpers such as HomeDir or DiffDir
+// always work with the raw output.
+func (s *SSHConn) SetOutputEncoding(enc encoding.Encoding) {
+	s.encoding = enc
+}
+
+// SetNormalizeNewlines makes Output and CombinedOutput convert CRLF line endings to LF,
+// e.g. for OpenSSH on Windows. Don't enable it for commands producing binary output.
+func (s *SSHConn) SetNormalizeNewlines(enabled bool) {
+	s.normalizeNL = enabled
+}
+
+// convertOutput applies the connection's output encoding and newline normalization to out.
+func (s *SSHConn) convertOutput(out []byte, err error) ([]byte, error) {
+	if s.encoding != nil {
+		decoded, derr := s.encoding.NewDecoder().Bytes(out)
+		if derr != nil {
+			if err == nil {
+				err = derr
+			}
+			return out, err
+		}
+		out = decoded
+	}
+	if s.normalizeNL {
+		out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+	}
+	return out, err
+}
+
+// OutputLive runs cmd like Output, additionally calling onLine with every line
+// of the standard output, without the line terminator, as soon as it arrives.
+func (s *SSHConn) OutputLive(cmd string, in io.Reader, onLine func(line string)) ([]byte, error) {
+	var b bytes.Buffer
+	lw := &lineWriter{onLine: onLine}
+	err := s.classifyExit(s.run(cmd, in, io.MultiWriter(&b, lw), nil))
+	lw.flush()
+	return s.convertOutput(b.Bytes(), err)
+}
+
+// lineWriter calls onLine for every complete line written to it.
+type lineWriter struct {
+	onLine func(line string)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes the incomplete last line, if any, to onLine.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.onLine(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// OutputLines runs cmd like Output and returns its output split into lines.
+// Surrounding whitespace is trimmed from every line and no empty trailing line is returned.
+func (s *SSHConn) OutputLines(cmd string, in io.Reader) ([]string, error) {
+	out, err := s.Output(cmd, in)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimRight(string(out), "\r\n")
+	if text == "" {
+		return nil, nil
+	}
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return lines, nil
+}
+
+// OutputFields runs cmd like Output and returns its output split into whitespace-separated fields.
+func (s *SSHConn) OutputFields(cmd string, in io.Reader) ([]string, error) {
+	out, err := s.Output(cmd, in)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// A WriterError is returned when writing the command's output to a caller-supplied writer fails.
+// The command's session is closed as soon as this happens.
+type WriterError struct {
+	Stream string // "stdout" or "stderr"
+	Err    error
+}
+
+func (e *WriterError) Error() string {
+	return fmt.Sprintf("writing %s: %v", e.Stream, e.Err)
+}
+
+func (e *WriterError) Unwrap() error {
+	return e.Err
+}
+
+// outputGuard watches the output written to a session's writers
+// and closes the session once it can't be delivered any more.
+type outputGuard struct {
+	mu        sync.Mutex
+	session   *ssh.Session
+	limited   bool
+	remaining int64
+	err       error
+}
+
+func (s *SSHConn) newOutputGuard(session *ssh.Session) *outputGuard {
+	return &outputGuard{
+		session:   session,
+		limited:   s.maxOutput > 0,
+		remaining: s.maxOutput,
+	}
+}
+
+// wrap returns w guarded for the given stream.
+func (g *outputGuard) wrap(w io.Writer, stream string) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &guardedWriter{guard: g, w: w, stream: stream}
+}
+
+// check returns the reason the session was closed, if any, and err otherwise.
+func (g *outputGuard) check(err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	return err
+}
+
+func (g *outputGuard) take(n int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	if !g.limited {
+		return nil
+	}
+	if int64(n) > g.remaining {
+		return g.abortLocked(ErrOutputTooLarge)
+	}
+	g.remaining -= int64(n)
+	return nil
+}
+
+func (g *outputGuard) abort(err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.abortLocked(err)
+}
+
+func (g *outputGuard) abortLocked(err error) error {
+	if g.err == nil {
+		g.err = err
+		// stop the remote side from producing more
+		g.session.Close()
+	}
+	return g.err
+}
+
+type guardedWriter struct {
+	guard  *outputGuard
+	w      io.Writer
+	stream string
+}
+
+func (w *guardedWriter) Write(p []byte) (int, error) {
+	if err := w.guard.take(len(p)); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, w.guard.abort(&WriterError{Stream: w.stream, Err: err})
+	}
+	return n, nil
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes,
+// used to combine standard output and standard error.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Bytes()
+}
@@ -0,0 +1,74 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// A PrefixWriter writes each line to the underlying writer prefixed with a fixed string.
+// Lines are written whole, so several PrefixWriters may share a writer without mixing lines.
+type PrefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter writing to w.
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes the pending incomplete line, if any, terminated with a newline.
+func (p *PrefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *PrefixWriter) writeLine(line []byte) error {
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// RunPrefixed is like Run but prefixes every line of the command's output with prefix,
+// e.g. the host name, to keep output of several hosts readable.
+func (s *SSHConn) RunPrefixed(cmd string, prefix string, in io.Reader, outWriter, errWriter io.Writer) error {
+	var stdout, stderr io.Writer
+	if outWriter != nil {
+		pw := NewPrefixWriter(outWriter, prefix)
+		defer pw.Flush()
+		stdout = pw
+	}
+	if errWriter != nil {
+		pw := NewPrefixWriter(errWriter, prefix)
+		defer pw.Flush()
+		stderr = pw
+	}
+	return s.Run(cmd, in, stdout, stderr)
+}
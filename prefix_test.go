@@ -0,0 +1,87 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{writes: nil, want: ""},
+		{writes: []string{"a\n"}, want: "web1: a\n"},
+		{writes: []string{"a\nb\n"}, want: "web1: a\nweb1: b\n"},
+		{writes: []string{"a", "b", "\n"}, want: "web1: ab\n"},
+		{writes: []string{"a\nb"}, want: "web1: a\nweb1: b\n"},
+		{writes: []string{"\n\n"}, want: "web1: \nweb1: \n"},
+		{writes: []string{"a\r\n"}, want: "web1: a\r\n"},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		p := NewPrefixWriter(&b, "web1: ")
+		for _, w := range tt.writes {
+			if n, err := p.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("writes %q: got %q, want %q", tt.writes, b.String(), tt.want)
+		}
+	}
+}
+
+func TestPrefixWriterWholeLines(t *testing.T) {
+	var (
+		mu sync.Mutex
+		b  bytes.Buffer
+	)
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return b.Write(p)
+	})
+
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"a: ", "b: "} {
+		p := NewPrefixWriter(w, prefix)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// lines split across writes must not interleave with the other writer
+				p.Write([]byte("hello "))
+				p.Write([]byte("world\n"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		if line != "a: hello world" && line != "b: hello world" {
+			t.Fatalf("mixed line %q", line)
+		}
+	}
+}
+
+func TestPrefixWriterError(t *testing.T) {
+	errWrite := errors.New("write failed")
+	p := NewPrefixWriter(writerFunc(func([]byte) (int, error) { return 0, errWrite }), "> ")
+	if _, err := p.Write([]byte("a\n")); err != errWrite {
+		t.Errorf("Write returned %v, want %v", err, errWrite)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
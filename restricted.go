@@ -0,0 +1,65 @@
+package sshwrapper
+
+import (
+	"errors"
+	"io"
+	"regexp"
+)
+
+// ErrCommandNotAllowed is returned by RestrictedConn for commands not matching its allowlist.
+var ErrCommandNotAllowed = errors.New("command not allowed")
+
+// A RestrictedConn runs only the commands matching its allowlist.
+type RestrictedConn struct {
+	conn    *SSHConn
+	allowed []*regexp.Regexp
+}
+
+// NewRestrictedConn returns a RestrictedConn running commands over conn.
+// A command is allowed if it matches any of the patterns in full,
+// as if they were anchored with ^ and $.
+func NewRestrictedConn(conn *SSHConn, allowed ...*regexp.Regexp) *RestrictedConn {
+	anchored := make([]*regexp.Regexp, len(allowed))
+	for i, re := range allowed {
+		anchored[i] = regexp.MustCompile(`^(?:` + re.String() + `)$`)
+	}
+	return &RestrictedConn{conn: conn, allowed: anchored}
+}
+
+func (r *RestrictedConn) check(cmd string) error {
+	for _, re := range r.allowed {
+		if re.MatchString(cmd) {
+			return nil
+		}
+	}
+	return ErrCommandNotAllowed
+}
+
+// Output is like SSHConn.Output but fails with ErrCommandNotAllowed for commands not in the allowlist.
+func (r *RestrictedConn) Output(cmd string, in io.Reader) ([]byte, error) {
+	if err := r.check(cmd); err != nil {
+		return nil, err
+	}
+	return r.conn.Output(cmd, in)
+}
+
+// CombinedOutput is like SSHConn.CombinedOutput but fails with ErrCommandNotAllowed for commands not in the allowlist.
+func (r *RestrictedConn) CombinedOutput(cmd string, in io.Reader) ([]byte, error) {
+	if err := r.check(cmd); err != nil {
+		return nil, err
+	}
+	return r.conn.CombinedOutput(cmd, in)
+}
+
+// Run is like SSHConn.Run but fails with ErrCommandNotAllowed for commands not in the allowlist.
+func (r *RestrictedConn) Run(cmd string, in io.Reader, outWriter, errWriter io.Writer) error {
+	if err := r.check(cmd); err != nil {
+		return err
+	}
+	return r.conn.Run(cmd, in, outWriter, errWriter)
+}
+
+// Close closes the underlying connection.
+func (r *RestrictedConn) Close() {
+	r.conn.Close()
+}
@@ -0,0 +1,47 @@
+package sshwrapper
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRestrictedConnCheck(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		cmd      string
+		allowed  bool
+	}{
+		{patterns: []string{`ls`}, cmd: "ls", allowed: true},
+		{patterns: []string{`ls`}, cmd: "ls; rm -rf /", allowed: false},
+		{patterns: []string{`ls`}, cmd: "rm -rf / # ls", allowed: false},
+		{patterns: []string{`ls`}, cmd: "ls\nrm -rf /", allowed: false},
+		{patterns: []string{`ls`}, cmd: "rm -rf /\nls", allowed: false},
+		{patterns: []string{`^ls$`}, cmd: "ls", allowed: true},
+		{patterns: []string{`(?m)^ls$`}, cmd: "ls\nrm -rf /", allowed: false},
+		{patterns: []string{`ls|df`}, cmd: "df", allowed: true},
+		{patterns: []string{`ls|df`}, cmd: "ls; df; rm -rf /", allowed: false},
+		{patterns: []string{`systemctl status [a-z-]+`}, cmd: "systemctl status nginx", allowed: true},
+		{patterns: []string{`systemctl status [a-z-]+`}, cmd: "systemctl status nginx; reboot", allowed: false},
+		{patterns: []string{`(?i)uptime`}, cmd: "UPTIME", allowed: true},
+		{patterns: []string{`(?i)uptime`}, cmd: "Uptime && reboot", allowed: false},
+		{patterns: []string{`(?s)echo .*`}, cmd: "echo a\nb", allowed: true},
+		{patterns: []string{`uptime`, `df -h`}, cmd: "df -h", allowed: true},
+		{patterns: []string{`uptime`, `df -h`}, cmd: "df", allowed: false},
+		{patterns: nil, cmd: "ls", allowed: false},
+	}
+
+	for _, tt := range tests {
+		res := make([]*regexp.Regexp, len(tt.patterns))
+		for i, p := range tt.patterns {
+			res[i] = regexp.MustCompile(p)
+		}
+		r := NewRestrictedConn(nil, res...)
+		err := r.check(tt.cmd)
+		if tt.allowed && err != nil {
+			t.Errorf("patterns %q: %q rejected: %v", tt.patterns, tt.cmd, err)
+		}
+		if !tt.allowed && err != ErrCommandNotAllowed {
+			t.Errorf("patterns %q: %q allowed", tt.patterns, tt.cmd)
+		}
+	}
+}
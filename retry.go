@@ -0,0 +1,133 @@
+package sshwrapper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RunRetryCodes runs cmd like Run, retrying it up to attempts times in total
+// as long as it exits with one of codes, e.g. while a package manager lock is held.
+// The delay before each retry starts at backoff and doubles after every retry.
+//
+// The output of all attempts is written to outWriter and errWriter.
+func (s *SSHConn) RunRetryCodes(cmd string, codes []int, attempts int, backoff time.Duration, outWriter, errWriter io.Writer) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = s.Run(cmd, nil, outWriter, errWriter)
+		if attempt >= attempts || !hasExitCode(err, codes) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// A Policy specifies how RunWithPolicy runs and retries a command.
+type Policy struct {
+	// Attempts is the maximum number of attempts in total; zero means one.
+	Attempts int
+	// Timeout limits each attempt; the command is killed when it elapses. Zero means no limit.
+	Timeout time.Duration
+	// Backoff is the delay before the first retry, doubling after every retry.
+	Backoff time.Duration
+	// RetryCodes lists the exit codes after which the command is retried.
+	RetryCodes []int
+	// Retry, if set, reports whether the command is retried after failing with err.
+	// A timed out attempt fails with context.DeadlineExceeded.
+	Retry func(err error) bool
+}
+
+// RunWithPolicy runs cmd like Run, limiting and retrying its attempts according to policy.
+//
+// The output of all attempts is written to outWriter and errWriter.
+func (s *SSHConn) RunWithPolicy(cmd string, policy Policy, outWriter, errWriter io.Writer) error {
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := s.runAttempt(cmd, policy.Timeout, outWriter, errWriter)
+		if err == nil || attempt >= policy.Attempts {
+			return err
+		}
+		if !hasExitCode(err, policy.RetryCodes) && (policy.Retry == nil || !policy.Retry(err)) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *SSHConn) runAttempt(cmd string, timeout time.Duration, outWriter, errWriter io.Writer) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	c, err := s.Start(ctx, cmd, nil, outWriter, errWriter)
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// hasExitCode reports whether err is an exit error with one of codes.
+func hasExitCode(err error, codes []int) bool {
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, code := range codes {
+		if exitErr.ExitStatus() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputResilient dials addr like Dial, runs cmd like Output and closes the connection.
+// If the connection is lost while dialing or running the command, it dials again and
+// reruns the command, up to attempts times in total. The caller asserts cmd is idempotent.
+// The delay before each retry starts at backoff and doubles after every retry.
+func OutputResilient(addr string, socket string, forwardAgent bool, cmd string, attempts int, backoff time.Duration) ([]byte, error) {
+	var (
+		out []byte
+		err error
+	)
+	for attempt := 1; ; attempt++ {
+		out, err = outputOnce(addr, socket, forwardAgent, cmd)
+		if attempt >= attempts || !isConnectionLost(err) {
+			return out, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func outputOnce(addr string, socket string, forwardAgent bool, cmd string) ([]byte, error) {
+	conn, err := Dial(addr, socket, forwardAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Output(cmd, nil)
+}
+
+// isConnectionLost reports whether err means the connection to the server broke.
+func isConnectionLost(err error) bool {
+	var (
+		missing *ssh.ExitMissingError
+		opErr   *net.OpError
+	)
+	if errors.As(err, &opErr) && (opErr.Op == "read" || opErr.Op == "write") {
+		// e.g. connection reset by peer or broken pipe
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &missing)
+}
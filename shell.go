@@ -0,0 +1,191 @@
+package sshwrapper
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// processTagEnv is the environment variable marking processes started by the wrapper.
+const processTagEnv = "SSHWRAPPER_TAG"
+
+// wrapCommand applies the connection's command options to cmd.
+func (s *SSHConn) wrapCommand(cmd string) string {
+	var prefix string
+	if s.envBase64 && len(s.envs) > 0 {
+		prefix += `eval "$(printf %s ` + s.encodedEnvs() + ` | base64 -d)"; `
+	} else {
+		for _, k := range s.envNames() {
+			if s.envs[k] == "" {
+				prefix += "export " + k + "=; "
+			}
+		}
+	}
+	if s.locale != "" {
+		prefix += "LANG=" + shellQuote(s.locale) + "; LC_ALL=" + shellQuote(s.locale) + "; export LANG LC_ALL; "
+	}
+	if s.umask != "" {
+		prefix += "umask " + s.umask + "; "
+	}
+	if s.processTag != "" {
+		prefix += processTagEnv + "=" + shellQuote(s.processTag) + "; export " + processTagEnv + "; "
+	}
+	if s.nice != 0 {
+		cmd = fmt.Sprintf(`exec nice -n %d "${SHELL:-/bin/sh}" -c %s`, s.nice, shellQuote(cmd))
+	}
+	return prefix + cmd
+}
+
+// SetEnvBase64 makes the connection deliver the environment set by SetEnvs
+// as a single base64 encoded blob exported by a shell preamble of every command,
+// instead of setting each variable with an "env" request. This works regardless
+// of the server's AcceptEnv setting, but only for commands run by
+// Output/CombinedOutput/Run/Start. Variables whose names aren't valid shell identifiers are skipped.
+func (s *SSHConn) SetEnvBase64(enabled bool) {
+	s.envBase64 = enabled
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// encodedEnvs returns the shell-quoted base64 encoding of export statements for the connection's environment.
+func (s *SSHConn) encodedEnvs() string {
+	var b strings.Builder
+	for _, k := range s.envNames() {
+		b.WriteString("export " + k + "=" + shellQuote(s.envs[k]) + "\n")
+	}
+	return shellQuote(base64.StdEncoding.EncodeToString([]byte(b.String())))
+}
+
+// envNames returns the sorted names of the connection's environment variables
+// that are valid shell identifiers.
+func (s *SSHConn) envNames() []string {
+	names := make([]string, 0, len(s.envs))
+	for k := range s.envs {
+		if envNameRe.MatchString(k) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetLocale makes every command executed by the connection run with LANG and LC_ALL
+// set to locale, e.g. "C" for output that doesn't depend on the host's language.
+// An empty locale restores the default.
+func (s *SSHConn) SetLocale(locale string) {
+	s.locale = locale
+}
+
+// SetUmask makes every command executed by the connection run with the given umask,
+// e.g. 0022, regardless of the remote login default. A negative mask restores the default.
+func (s *SSHConn) SetUmask(mask int) {
+	if mask < 0 {
+		s.umask = ""
+		return
+	}
+	s.umask = fmt.Sprintf("%04o", mask&0777)
+}
+
+// SetNice makes every command executed by the connection run with the given niceness,
+// e.g. 10 for background maintenance that shouldn't starve production workloads.
+// Zero restores the default priority.
+func (s *SSHConn) SetNice(n int) {
+	s.nice = n
+}
+
+// SetProcessTag marks every command executed by the connection with tag
+// so that its processes can later be found by KillTagged, e.g. after a crash.
+// An empty tag disables marking.
+func (s *SSHConn) SetProcessTag(tag string) {
+	s.processTag = tag
+}
+
+// KillTagged terminates the remote processes marked with the tag set by SetProcessTag,
+// including processes started by earlier connections with the same tag.
+//
+// Processes are found by their environment, so this works on Linux hosts only.
+func (s *SSHConn) KillTagged() error {
+	if s.processTag == "" {
+		return nil
+	}
+
+	session, err := s.newSession(false)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	script := `for d in /proc/[0-9]*; do
+	p=${d#/proc/}
+	[ "$p" = "$$" ] && continue
+	tr '\0' '\n' < "$d/environ" 2>/dev/null | grep -qxF ` + shellQuote(processTagEnv+"="+s.processTag) + ` && kill "$p" 2>/dev/null
+done
+exit 0`
+	return session.Run(script)
+}
+
+// posixShells lists the names of the login shells known to be POSIX compatible.
+var posixShells = map[string]bool{
+	"sh":      true,
+	"ash":     true,
+	"dash":    true,
+	"bash":    true,
+	"ksh":     true,
+	"ksh93":   true,
+	"mksh":    true,
+	"pdksh":   true,
+	"zsh":     true,
+	"yash":    true,
+	"posh":    true,
+	"busybox": true,
+}
+
+// ShellInfo returns the path of the remote login shell, which executes the commands,
+// and whether it is known to be POSIX compatible. Wrapping features such as SetUmask,
+// SetNice or SetEnvBase64 rely on a POSIX shell.
+func (s *SSHConn) ShellInfo() (shellPath string, posix bool, err error) {
+	session, err := s.newSession(false)
+	if err != nil {
+		return "", false, err
+	}
+	defer session.Close()
+
+	// understood by POSIX shells as well as csh and fish
+	out, err := session.Output("echo $SHELL")
+	if err != nil {
+		return "", false, err
+	}
+	shellPath = strings.TrimSpace(string(out))
+	return shellPath, posixShells[path.Base(shellPath)], nil
+}
+
+// RunTemplate runs the multi-line script on the remote host like Run, after substituting
+// its {{.Name}} placeholders with the shell-quoted values of args. The script is fed
+// to `bash -s` via stdin, so its length isn't limited. Placeholders missing from args are an error.
+func (s *SSHConn) RunTemplate(script string, args map[string]string, outWriter, errWriter io.Writer) error {
+	tmpl, err := template.New("script").Option("missingkey=error").Parse(script)
+	if err != nil {
+		return err
+	}
+
+	quoted := make(map[string]string, len(args))
+	for k, v := range args {
+		quoted[k] = shellQuote(v)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, quoted); err != nil {
+		return err
+	}
+
+	return s.Run("bash -s", strings.NewReader(b.String()), outWriter, errWriter)
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
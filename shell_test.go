@@ -0,0 +1,136 @@
+package sshwrapper
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runWrapped runs the command wrapped by s in a local POSIX shell, as the remote
+// login shell would, and returns its output.
+func runWrapped(t *testing.T, s *SSHConn, cmd string) string {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	c := exec.Command("sh", "-c", s.wrapCommand(cmd))
+	c.Env = append(os.Environ(), "SHELL=/bin/sh")
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q: %v: %s", s.wrapCommand(cmd), err, out)
+	}
+	return string(out)
+}
+
+func TestWrapCommandNoOptions(t *testing.T) {
+	s := &SSHConn{}
+	if got := s.wrapCommand("echo hi"); got != "echo hi" {
+		t.Errorf("wrapCommand = %q, want the command unchanged", got)
+	}
+}
+
+func TestWrapCommandUmask(t *testing.T) {
+	for _, tt := range []struct {
+		mask int
+		want string
+	}{
+		{mask: 0022, want: "0022\n"},
+		{mask: 0077, want: "0077\n"},
+		{mask: 02027, want: "0027\n"},
+	} {
+		s := &SSHConn{}
+		s.SetUmask(tt.mask)
+		if got := runWrapped(t, s, "umask"); got != tt.want {
+			t.Errorf("SetUmask(%#o): umask printed %q, want %q", tt.mask, got, tt.want)
+		}
+	}
+
+	s := &SSHConn{}
+	s.SetUmask(0077)
+	s.SetUmask(-1)
+	if got := s.wrapCommand("umask"); got != "umask" {
+		t.Errorf("SetUmask(-1): wrapCommand = %q, want the command unchanged", got)
+	}
+}
+
+func TestWrapCommandEnvBase64(t *testing.T) {
+	if _, err := exec.LookPath("base64"); err != nil {
+		t.Skip("base64 not found")
+	}
+	s := &SSHConn{}
+	s.SetEnvs(map[string]string{
+		"PLAIN":      "value",
+		"QUOTES":     `it's "quoted"`,
+		"SPECIAL":    "$(touch /tmp/pwned) `id` \\n\nsecond line",
+		"EMPTY":      "",
+		"NOT-A-NAME": "skipped",
+	})
+	s.SetEnvBase64(true)
+
+	got := runWrapped(t, s, `printf '%s|' "$PLAIN" "$QUOTES" "$SPECIAL" "${EMPTY-unset}"; env | grep -c '^NOT-A-NAME=' || true`)
+	want := "value|it's \"quoted\"|$(touch /tmp/pwned) `id` \\n\nsecond line||0\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapCommandNice(t *testing.T) {
+	if _, err := exec.LookPath("nice"); err != nil {
+		t.Skip("nice not found")
+	}
+	base, err := strconv.Atoi(strings.TrimSpace(runWrapped(t, &SSHConn{}, "nice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base > 14 {
+		t.Skipf("test process already runs at niceness %d", base)
+	}
+
+	s := &SSHConn{}
+	s.SetNice(5)
+	// the command keeps its shell syntax and quoting under nice
+	got := runWrapped(t, s, `echo "$(nice) 'quoted'"`)
+	if want := fmt.Sprintf("%d 'quoted'\n", base+5); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapCommandEmptyEnv(t *testing.T) {
+	s := &SSHConn{}
+	s.SetEnvs(map[string]string{
+		"SSHWRAPPER_EMPTY": "",
+		"SSHWRAPPER_SET":   "sent with an env request",
+		"NOT-A-NAME":       "",
+	})
+
+	// only the empty variables are exported by the command, the others are set by newSession
+	got := runWrapped(t, s, `echo "${SSHWRAPPER_EMPTY+set}|${SSHWRAPPER_SET+set}"; env | grep -c '^SSHWRAPPER_EMPTY=$'`)
+	if want := "set|\n1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapCommandLocale(t *testing.T) {
+	s := &SSHConn{}
+	s.SetLocale("C.UTF-8")
+	got := runWrapped(t, s, `echo "$LANG|$LC_ALL"; env | grep -c '^LC_ALL=C.UTF-8$'`)
+	if want := "C.UTF-8|C.UTF-8\n1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// all options at once, in the order the preamble applies them
+	s.SetUmask(0027)
+	s.SetProcessTag("deploy 42")
+	got = runWrapped(t, s, `echo "$LANG $(umask) $SSHWRAPPER_TAG"`)
+	if want := "C.UTF-8 0027 deploy 42\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	s.SetLocale("")
+	if got := runWrapped(t, s, `echo "${LC_ALL-unset}"`); got == "C.UTF-8\n" {
+		t.Errorf("SetLocale(\"\") kept the locale")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package sshwrapper
+
+// setSocketBuffers is a no-op on platforms without socket options.
+func setSocketBuffers(fd uintptr, sndbuf, rcvbuf int) error {
+	return nil
+}
@@ -1,26 +1,80 @@
 package sshwrapper
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/text/encoding"
 )
 
 // ConnTimeout specifies the maximum amount of time for the TCP connection to establish
 var ConnTimeout = 60 * time.Second
 
+// MaxCommandLength specifies the maximum length of a command sent as the exec string.
+// Longer commands are delivered to `bash -s` via stdin. Zero disables the check.
+var MaxCommandLength = 64 * 1024
+
+// HostResolver, if set, is consulted by Dial to expand the host of the connection string
+// before connecting, e.g. to turn an alias "web1" into "web1.prod.internal".
+var HostResolver func(host string) (string, error)
+
+// Rand specifies the source of entropy for the SSH handshake, e.g. a FIPS-approved DRBG.
+// If nil, crypto/rand is used.
+var Rand io.Reader
+
+// RekeyThreshold specifies the number of bytes sent or received after which a new key is negotiated.
+// If zero, the golang.org/x/crypto/ssh default for the cipher is used.
+var RekeyThreshold uint64
+
+// HandshakeRetries specifies how many times a failed SSH handshake is retried
+// over a fresh TCP connection, e.g. while the server is restarting.
+var HandshakeRetries = 0
+
+// HandshakeRetryDelay specifies the delay between handshake retries.
+var HandshakeRetryDelay = time.Second
+
+// ErrNoAgentKeys is returned by Dial when the authentication agent holds no keys.
+var ErrNoAgentKeys = errors.New("no keys in ssh agent (forgot ssh-add?)")
+
+// ErrEmptyCommand is returned when running an empty command or requesting
+// a subsystem with an empty name, which servers handle inconsistently.
+var ErrEmptyCommand = errors.New("empty command")
+
 // A SSHConn represents a connection to run remote commands.
 type SSHConn struct {
 	client       *ssh.Client
 	agentConn    net.Conn
+	fwdAgent     *agentProxy
 	forwardAgent bool
+	heldSessions int // sessions kept open for the lifetime of the connection
 	envs         map[string]string
+	envBase64    bool
+	stderrTail   int
+	processTag   string
+	maxOutput    int64
+	umask        string
+	nice         int
+	locale       string
+	id           string
+	exitOK       func(code int) bool
+	encoding     encoding.Encoding
+	normalizeNL  bool
+
+	mu        sync.Mutex
+	homeDir   string
+	tempFiles map[string]bool
+
+	dialMu sync.Mutex
+	dial   func() (*SSHConn, error)
 }
 
 // Dial creates a client connection to the given SSH server.
@@ -31,6 +85,17 @@ type SSHConn struct {
 //
 // if `forwardAgent` is true then forwarding of the authentication agent connection will be enabled.
 func Dial(addr string, socket string, forwardAgent bool) (*SSHConn, error) {
+	return DialTransport(addr, socket, forwardAgent, nil)
+}
+
+// DialTransport is like Dial but opens the underlying connection with transport.
+// A nil transport dials TCP.
+func DialTransport(addr string, socket string, forwardAgent bool, transport Transport) (*SSHConn, error) {
+	return dial(addr, socket, forwardAgent, transport, nil)
+}
+
+// dial connects like DialTransport and then performs steps, if any, like DialOnConnect.
+func dial(addr string, socket string, forwardAgent bool, transport Transport, steps []ConnectStep) (*SSHConn, error) {
 	agentConn, err := net.Dial("unix", socket)
 	if err != nil {
 		return nil, err
@@ -47,19 +112,36 @@ func Dial(addr string, socket string, forwardAgent bool) (*SSHConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(signers) == 0 {
+		return nil, ErrNoAgentKeys
+	}
 
 	host, port, user, err := ParseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
+	if HostResolver != nil {
+		if host, err = HostResolver(host); err != nil {
+			return nil, err
+		}
+	}
+
+	hostport := net.JoinHostPort(host, strconv.Itoa(port))
+	hostKeyAlgos, err := hostKeyAlgorithms(hostport)
+	if err != nil {
+		return nil, err
+	}
 
 	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
-		Timeout:         ConnTimeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:              user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		Timeout:           ConnTimeout,
+		HostKeyCallback:   hostKeyCallback(),
+		HostKeyAlgorithms: hostKeyAlgos,
 	}
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
+	config.Rand = Rand
+	config.RekeyThreshold = RekeyThreshold
+	client, err := dialClient(hostport, config, transport)
 	if err != nil {
 		return nil, err
 	}
@@ -70,26 +152,78 @@ func Dial(addr string, socket string, forwardAgent bool) (*SSHConn, error) {
 		}
 	}()
 
+	fwdAgent := &agentProxy{agent: sshAgent}
 	if forwardAgent {
-		if err := agent.ForwardToAgent(client, sshAgent); err != nil {
+		if err := agent.ForwardToAgent(client, fwdAgent); err != nil {
 			return nil, fmt.Errorf("SetupForwardKeyring: %v", err)
 		}
 	}
 
+	var heldSessions int
+	if len(steps) > 0 {
+		if err := interact(client, steps); err != nil {
+			return nil, fmt.Errorf("connect steps: %v", err)
+		}
+		heldSessions = 1
+	}
+
 	agentOk = true
 	clientOk = true
 
 	c := SSHConn{
 		client:       client,
 		agentConn:    agentConn,
+		fwdAgent:     fwdAgent,
 		forwardAgent: forwardAgent,
+		heldSessions: heldSessions,
+	}
+	return &c, nil
+}
+
+// DialConfig creates a client connection to the given SSH server using cfg as is,
+// for callers that build their own ssh.ClientConfig. The user of `addr` is only used
+// if cfg has none. The connection has no authentication agent to forward.
+func DialConfig(addr string, cfg *ssh.ClientConfig) (*SSHConn, error) {
+	host, port, user, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if HostResolver != nil {
+		if host, err = HostResolver(host); err != nil {
+			return nil, err
+		}
+	}
+
+	config := *cfg
+	if config.User == "" {
+		config.User = user
+	}
+	client, err := dialClient(net.JoinHostPort(host, strconv.Itoa(port)), &config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := SSHConn{
+		client: client,
 	}
 	return &c, nil
 }
 
 // Close closes the connection
 func (s *SSHConn) Close() {
-	s.agentConn.Close()
+	s.cleanupOnClose()
+
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+
+	// a lazy connection may have never been established
+	s.dial = nil
+	if s.client == nil {
+		return
+	}
+	if s.agentConn != nil {
+		s.agentConn.Close()
+	}
 	s.client.Close()
 }
 
@@ -103,119 +237,248 @@ func (s *SSHConn) requestAgentForwarding(session *ssh.Session) error {
 	return nil
 }
 
-// Output runs cmd on the remote host and returns its standard output.
-func (s *SSHConn) Output(cmd string, in io.Reader) ([]byte, error) {
+// newSession opens a new session with agent forwarding and
+// the environment already applied.
+//
+// Variables with empty values are set only if sendEmpty is true, as some servers
+// reject them; commands run by the wrapper export them in their preamble instead.
+func (s *SSHConn) newSession(sendEmpty bool) (*ssh.Session, error) {
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
 	session, err := s.client.NewSession()
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
+	var ok bool
+	defer func() {
+		if !ok {
+			session.Close()
+		}
+	}()
 
 	if err := s.requestAgentForwarding(session); err != nil {
 		return nil, err
 	}
 
-	for k, v := range s.envs {
-		if err := session.Setenv(k, v); err != nil {
-			return nil, err
+	if !s.envBase64 {
+		for k, v := range s.envs {
+			if v == "" && !sendEmpty {
+				continue
+			}
+			if err := session.Setenv(k, v); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	session.Stdin = in
+	ok = true
+	return session, nil
+}
 
-	return session.Output(cmd)
+// A Session is a session opened on the connection with agent forwarding
+// and the environment already applied. It exposes the full ssh.Session API.
+type Session struct {
+	*ssh.Session
 }
 
-// CombinedOutput runs cmd on the remote host and returns its combined standard output and standard error.
-func (s *SSHConn) CombinedOutput(cmd string, in io.Reader) ([]byte, error) {
-	session, err := s.client.NewSession()
+// NewSession opens a new session for callers that need more control
+// than Output/CombinedOutput/Run provide, e.g. RequestSubsystem or custom requests.
+//
+// Since the session's command is not wrapped, variables set to empty values by SetEnvs
+// are sent with "env" requests like the others, which fails if the server rejects them.
+//
+// The caller is responsible for closing the session.
+func (s *SSHConn) NewSession() (*Session, error) {
+	session, err := s.newSession(true)
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
+	return &Session{Session: session}, nil
+}
 
-	if err := s.requestAgentForwarding(session); err != nil {
-		return nil, err
+// prepareCommand returns the command to execute and the reader to use as its stdin.
+// Commands longer than MaxCommandLength are fed to `bash -s` via stdin
+// followed by the original input.
+func (s *SSHConn) prepareCommand(cmd string, in io.Reader) (string, io.Reader) {
+	cmd = s.wrapCommand(cmd)
+	if MaxCommandLength <= 0 || len(cmd) <= MaxCommandLength {
+		return cmd, in
+	}
+	// bash parses the whole group before running it, so the command
+	// sees only the original input on its stdin.
+	script := strings.NewReader("{\n" + cmd + "\n}; exit\n")
+	if in == nil {
+		return "bash -s", script
 	}
+	return "bash -s", io.MultiReader(script, in)
+}
 
-	for k, v := range s.envs {
-		if err := session.Setenv(k, v); err != nil {
-			return nil, err
-		}
+// run runs cmd in a new session with the connection's options applied.
+// The exit code classifier is not applied, see classifyExit.
+func (s *SSHConn) run(cmd string, in io.Reader, outWriter, errWriter io.Writer) error {
+	if strings.TrimSpace(cmd) == "" {
+		return ErrEmptyCommand
+	}
+
+	session, err := s.newSession(false)
+	if err != nil {
+		return s.withID(err)
 	}
+	defer session.Close()
+
+	guard := s.newOutputGuard(session)
+	session.Stdout = guard.wrap(outWriter, "stdout")
+	session.Stderr = guard.wrap(errWriter, "stderr")
+	cmd, session.Stdin = s.prepareCommand(cmd, in)
+	err = session.Run(cmd)
+	return s.withID(guard.check(signalError(err)))
+}
+
+// Output runs cmd on the remote host and returns its standard output.
+func (s *SSHConn) Output(cmd string, in io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	err := s.classifyExit(s.run(cmd, in, &b, nil))
+	return s.convertOutput(b.Bytes(), err)
+}
 
-	session.Stdin = in
+// outputRaw is Output without the exit code classifier and the output conversion,
+// for helpers interpreting the exit code and the output of their own commands.
+func (s *SSHConn) outputRaw(cmd string, in io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	err := s.run(cmd, in, &b, nil)
+	return b.Bytes(), err
+}
 
-	return session.CombinedOutput(cmd)
+// CombinedOutput runs cmd on the remote host and returns its combined standard output and standard error.
+func (s *SSHConn) CombinedOutput(cmd string, in io.Reader) ([]byte, error) {
+	var b lockedBuffer
+	err := s.classifyExit(s.run(cmd, in, &b, &b))
+	return s.convertOutput(b.Bytes(), err)
 }
 
 // Run runs cmd on the remote host.
+// If writing to outWriter or errWriter fails, the command's session is closed
+// and a *WriterError is returned.
 //
 // See https://godoc.org/golang.org/x/crypto/ssh#Session.Run for details.
 func (s *SSHConn) Run(cmd string, in io.Reader, outWriter, errWriter io.Writer) error {
-	session, err := s.client.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-
-	if err = s.requestAgentForwarding(session); err != nil {
-		return err
-	}
-
-	for k, v := range s.envs {
-		if err = session.Setenv(k, v); err != nil {
-			return err
-		}
-	}
+	return s.classifyExit(s.runRaw(cmd, in, outWriter, errWriter))
+}
 
-	session.Stdout = outWriter
-	session.Stderr = errWriter
-	session.Stdin = in
-	err = session.Run(cmd)
-	return err
+// runRaw is Run without the exit code classifier,
+// for helpers interpreting the exit code of their own commands.
+func (s *SSHConn) runRaw(cmd string, in io.Reader, outWriter, errWriter io.Writer) error {
+	errWriter, tail := s.teeStderr(errWriter)
+	err := s.run(cmd, in, outWriter, errWriter)
+	return withStderr(err, tail)
 }
 
 // SetEnvs specifies the environment that will be applied
 // to any command executed by Output/CombinedOutput/Run.
+//
+// Since some servers reject setting variables to empty values, such variables
+// are exported by a preamble of the command instead. Sessions running no such
+// command, e.g. those of NewSession or Subsystem, send them as is.
 func (s *SSHConn) SetEnvs(e map[string]string) {
 	s.envs = e
 }
 
+// SetID sets an identifier of the connection, e.g. a trace ID, that is included
+// in the errors returned by the commands run on it for correlation.
+func (s *SSHConn) SetID(id string) {
+	s.id = id
+}
+
+// ID returns the identifier set by SetID.
+func (s *SSHConn) ID() string {
+	return s.id
+}
+
+// withID prefixes err with the connection's identifier.
+// The original error remains available to errors.Is and errors.As.
+func (s *SSHConn) withID(err error) error {
+	if err == nil || s.id == "" {
+		return err
+	}
+	return fmt.Errorf("[%s] %w", s.id, err)
+}
+
 // ParseAddr parses SSH connection string and if everything is correct
 // returns three separate values -- host, port and user.
+//
+// The user is separated from the host at the last `@`, so it may contain `@` itself.
+// IPv6 hosts are given in brackets when followed by a port, e.g. "user@[::1]:2222",
+// and may be given bare otherwise, e.g. "user@fe80::1%eth0".
 func ParseAddr(s string) (host string, port int, user string, err error) {
+	return parseAddr(s, "")
+}
+
+// ParseAddrDefault is like ParseAddr but uses defaultHost
+// when the connection string contains no host, e.g. "deploy@" or "deploy@:2222".
+func ParseAddrDefault(s string, defaultHost string) (host string, port int, user string, err error) {
+	return parseAddr(s, defaultHost)
+}
+
+func parseAddr(s string, defaultHost string) (host string, port int, user string, err error) {
 	port = 22
 	user = "root"
 
 	origAddr := s
 
-	switch fields := strings.Split(s, "@"); {
-	case len(fields) == 1:
-	case len(fields) == 2:
-		if len(fields[1]) == 0 {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, s = s[:i], s[i+1:]
+	}
+
+	var portStr string
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
 			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
 		}
-		user, s = fields[0], fields[1]
+		host, s = s[1:end], s[end+1:]
+		if host == "" {
+			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+		}
+		if len(s) > 0 {
+			if s[0] != ':' || len(s) == 1 {
+				return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+			}
+			portStr = s[1:]
+		}
+	case strings.Count(s, ":") > 1:
+		// bare IPv6 address without a port
+		addr, _, _ := strings.Cut(s, "%")
+		if net.ParseIP(addr) == nil {
+			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+		}
+		host = s
 	default:
-		return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
-	}
-
-	switch fields := strings.Split(s, ":"); {
-	case len(fields) == 1:
-		host = fields[0]
-	case len(fields) == 2:
-		if len(fields[1]) == 0 {
+		var found bool
+		host, portStr, found = strings.Cut(s, ":")
+		if found && len(portStr) == 0 {
 			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
 		}
-		host = fields[0]
-		d, err := strconv.Atoi(fields[1])
+	}
+
+	if len(portStr) > 0 {
+		d, err := strconv.Atoi(portStr)
 		if err != nil {
 			return "", 0, "", err
 		}
+		if d < 1 || d > 65535 {
+			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+		}
 		port = d
-	default:
-		return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+	}
+
+	if host == "" {
+		if defaultHost == "" {
+			return "", 0, "", fmt.Errorf("incorrect addr format: %s", origAddr)
+		}
+		host = defaultHost
 	}
 
 	return
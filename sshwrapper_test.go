@@ -0,0 +1,125 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		defaultHost string
+		host        string
+		port        int
+		user        string
+		wantErr     bool
+	}{
+		{addr: "example.com", host: "example.com", port: 22, user: "root"},
+		{addr: "deploy@example.com", host: "example.com", port: 22, user: "deploy"},
+		{addr: "deploy@example.com:2222", host: "example.com", port: 2222, user: "deploy"},
+		{addr: "example.com:2222", host: "example.com", port: 2222, user: "root"},
+		{addr: "a@b@example.com", host: "example.com", port: 22, user: "a@b"},
+		{addr: "example.com:", wantErr: true},
+		{addr: "example.com:x", wantErr: true},
+		{addr: "example.com:0", wantErr: true},
+		{addr: "example.com:65536", wantErr: true},
+		{addr: "deploy@", wantErr: true},
+		{addr: "web1:22:33", wantErr: true},
+
+		{addr: "[::1]:2222", host: "::1", port: 2222, user: "root"},
+		{addr: "deploy@[::1]", host: "::1", port: 22, user: "deploy"},
+		{addr: "::1", host: "::1", port: 22, user: "root"},
+		{addr: "deploy@fe80::1%eth0", host: "fe80::1%eth0", port: 22, user: "deploy"},
+		{addr: "[fe80::1%eth0]:2222", host: "fe80::1%eth0", port: 2222, user: "root"},
+		{addr: "deploy@[]:22", wantErr: true},
+		{addr: "[::1", wantErr: true},
+		{addr: "[::1]2222", wantErr: true},
+		{addr: "[::1]:", wantErr: true},
+		{addr: "::1:2222:x", wantErr: true},
+
+		{addr: "deploy@", defaultHost: "bastion", host: "bastion", port: 22, user: "deploy"},
+		{addr: "deploy@:2222", defaultHost: "bastion", host: "bastion", port: 2222, user: "deploy"},
+		{addr: "deploy@example.com", defaultHost: "bastion", host: "example.com", port: 22, user: "deploy"},
+		{addr: "deploy@[]:22", defaultHost: "bastion", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		host, port, user, err := ParseAddrDefault(tt.addr, tt.defaultHost)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseAddrDefault(%q, %q) = %q, %d, %q, want error", tt.addr, tt.defaultHost, host, port, user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddrDefault(%q, %q) returned error: %v", tt.addr, tt.defaultHost, err)
+			continue
+		}
+		if host != tt.host || port != tt.port || user != tt.user {
+			t.Errorf("ParseAddrDefault(%q, %q) = %q, %d, %q, want %q, %d, %q",
+				tt.addr, tt.defaultHost, host, port, user, tt.host, tt.port, tt.user)
+		}
+	}
+}
+
+func TestParseAddrRequiresHost(t *testing.T) {
+	for _, addr := range []string{"deploy@", "deploy@:2222", ":2222", ""} {
+		if _, _, _, err := ParseAddr(addr); err == nil {
+			t.Errorf("ParseAddr(%q) succeeded, want error", addr)
+		}
+	}
+}
+
+func TestPrepareCommandBashFallback(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	defer func(n int) { MaxCommandLength = n }(MaxCommandLength)
+	MaxCommandLength = 64
+
+	long := ": " + strings.Repeat("x", 100) + "\n"
+	tests := []struct {
+		name string
+		cmd  string
+		in   io.Reader
+		want string
+		code int
+	}{
+		{name: "input", cmd: long + "cat", in: strings.NewReader("line 1\nline 2\n"), want: "line 1\nline 2\n"},
+		{name: "no input", cmd: long + "cat; echo done", want: "done\n"},
+		{name: "exit code", cmd: long + "read l; echo \"$l\"; exit 3", in: strings.NewReader("a\nexit 0\n"), want: "a\n", code: 3},
+		{name: "multi-line group", cmd: long + "while read l; do\n\techo \"<$l>\"\ndone", in: strings.NewReader("}\nexit 5\n"), want: "<}>\n<exit 5>\n"},
+	}
+
+	for _, tt := range tests {
+		s := &SSHConn{}
+		cmd, in := s.prepareCommand(tt.cmd, tt.in)
+		if cmd != "bash -s" {
+			t.Fatalf("%s: prepareCommand returned %q, want bash -s", tt.name, cmd)
+		}
+
+		// stdin is a pipe, as on the remote host
+		var out bytes.Buffer
+		c := exec.Command("bash", "-s")
+		c.Stdin = in
+		c.Stdout = &out
+		err := c.Run()
+		if out.String() != tt.want {
+			t.Errorf("%s: command printed %q, want %q", tt.name, out.String(), tt.want)
+		}
+		code := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if code != tt.code {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A RunError is returned by Run and Command.Wait when the remote command fails
+// and keeping of the standard error tail is enabled with SetStderrTail.
+type RunError struct {
+	Err    error
+	Stderr []byte
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, bytes.TrimSpace(e.Stderr))
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// SetStderrTail makes Run and Start keep the last n bytes of the standard error
+// in addition to streaming it to errWriter. If the command exits with an error,
+// the kept bytes are returned in a *RunError. Zero disables keeping.
+func (s *SSHConn) SetStderrTail(n int) {
+	s.stderrTail = n
+}
+
+// teeStderr returns the writer to use as the session's stderr
+// and the buffer keeping its tail, if enabled.
+func (s *SSHConn) teeStderr(errWriter io.Writer) (io.Writer, *tailBuffer) {
+	if s.stderrTail <= 0 {
+		return errWriter, nil
+	}
+	tail := &tailBuffer{size: s.stderrTail}
+	if errWriter == nil {
+		return tail, tail
+	}
+	return io.MultiWriter(errWriter, tail), tail
+}
+
+// withStderr wraps the remote command's exit error into a *RunError carrying the stderr tail.
+func withStderr(err error, tail *tailBuffer) error {
+	if tail == nil {
+		return err
+	}
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return &RunError{Err: err, Stderr: tail.buf}
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	buf  []byte
+	size int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= b.size {
+		b.buf = append(b.buf[:0], p[len(p)-b.size:]...)
+		return len(p), nil
+	}
+	if over := len(b.buf) + len(p) - b.size; over > 0 {
+		b.buf = b.buf[:copy(b.buf, b.buf[over:])]
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
@@ -0,0 +1,63 @@
+package sshwrapper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		size   int
+		writes []string
+		want   string
+	}{
+		{size: 8, writes: nil, want: ""},
+		{size: 8, writes: []string{"abc"}, want: "abc"},
+		{size: 8, writes: []string{"abc", "def"}, want: "abcdef"},
+		{size: 8, writes: []string{"abcdefgh"}, want: "abcdefgh"},
+		{size: 8, writes: []string{"abcdefghij"}, want: "cdefghij"},
+		{size: 8, writes: []string{"abcdef", "ghij"}, want: "cdefghij"},
+		{size: 8, writes: []string{"abc", "def", "ghi", "jkl"}, want: "efghijkl"},
+		{size: 8, writes: []string{"abcdefghij", "k"}, want: "defghijk"},
+		{size: 8, writes: []string{"abc", "", "d"}, want: "abcd"},
+	}
+
+	for _, tt := range tests {
+		b := &tailBuffer{size: tt.size}
+		for _, w := range tt.writes {
+			n, err := b.Write([]byte(w))
+			if n != len(w) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		if got := string(b.buf); got != tt.want {
+			t.Errorf("writes %q: kept %q, want %q", strings.Join(tt.writes, "|"), got, tt.want)
+		}
+	}
+}
+
+func TestWithStderr(t *testing.T) {
+	tail := &tailBuffer{buf: []byte("permission denied\n"), size: 64}
+
+	exitErr := &ssh.ExitError{}
+	var runErr *RunError
+	if err := withStderr(exitErr, tail); !errors.As(err, &runErr) || string(runErr.Stderr) != "permission denied\n" {
+		t.Errorf("withStderr(exit error) = %v, want a *RunError with the tail", err)
+	} else if !errors.Is(err, exitErr) {
+		t.Errorf("withStderr(exit error) doesn't wrap the exit error")
+	}
+
+	other := errors.New("connection lost")
+	if err := withStderr(other, tail); err != other {
+		t.Errorf("withStderr(other) = %v, want it unchanged", err)
+	}
+	if err := withStderr(exitErr, nil); err != exitErr {
+		t.Errorf("withStderr without tail = %v, want it unchanged", err)
+	}
+	if err := withStderr(nil, tail); err != nil {
+		t.Errorf("withStderr(nil) = %v, want nil", err)
+	}
+}
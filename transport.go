@@ -0,0 +1,131 @@
+package sshwrapper
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Transport opens the underlying connection to the SSH server at addr (host:port).
+// The connection may be any byte stream, e.g. a websocket to an SSH gateway.
+type Transport func(addr string) (io.ReadWriteCloser, error)
+
+// SendBufferSize and ReceiveBufferSize specify the sizes of the TCP socket buffers
+// (SO_SNDBUF and SO_RCVBUF) for connections dialed over TCP, e.g. to tune transfers
+// over high bandwidth-delay-product links. Zero keeps the system default.
+var (
+	SendBufferSize    = 0
+	ReceiveBufferSize = 0
+)
+
+// controlSocketBuffers applies SendBufferSize and ReceiveBufferSize before connecting,
+// so that they are taken into account for TCP window scaling.
+func controlSocketBuffers(network, address string, c syscall.RawConn) error {
+	if SendBufferSize <= 0 && ReceiveBufferSize <= 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setSocketBuffers(fd, SendBufferSize, ReceiveBufferSize)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// SelectAddr, if set, chooses which of the addresses a host name resolves to
+// is dialed over TCP, e.g. the one with the lowest latency or in the nearest region.
+// Host keys are still verified for the host name.
+var SelectAddr func(host string, addrs []net.IP) (net.IP, error)
+
+// selectAddr resolves the host of addr and replaces it with the address chosen by SelectAddr.
+func selectAddr(addr string) (string, error) {
+	if SelectAddr == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	ip, err := SelectAddr(host, ips)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// dialClient connects to addr and performs the SSH handshake,
+// retrying the handshake up to HandshakeRetries times.
+func dialClient(addr string, config *ssh.ClientConfig, transport Transport) (*ssh.Client, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := dialTransport(addr, config, transport)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err == nil {
+			return ssh.NewClient(c, chans, reqs), nil
+		}
+		conn.Close()
+		if attempt >= HandshakeRetries || !retryHandshake(err) {
+			return nil, err
+		}
+		time.Sleep(HandshakeRetryDelay)
+	}
+}
+
+// retryHandshake reports whether a failed handshake is worth retrying.
+// Retrying authentication failures and rejected host keys is pointless.
+func retryHandshake(err error) bool {
+	if errors.Is(err, ErrHostKeyMismatch) || errors.Is(err, ErrUnknownHost) {
+		return false
+	}
+	return !strings.Contains(err.Error(), "unable to authenticate")
+}
+
+func dialTransport(addr string, config *ssh.ClientConfig, transport Transport) (net.Conn, error) {
+	if transport == nil {
+		addr, err := selectAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := net.Dialer{Timeout: config.Timeout, Control: controlSocketBuffers}
+		return d.Dial("tcp", addr)
+	}
+	rwc, err := transport(addr)
+	if err != nil {
+		return nil, err
+	}
+	if conn, ok := rwc.(net.Conn); ok {
+		return conn, nil
+	}
+	return &streamConn{ReadWriteCloser: rwc}, nil
+}
+
+// streamConn adapts an io.ReadWriteCloser to net.Conn.
+type streamConn struct {
+	io.ReadWriteCloser
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
+
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
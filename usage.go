@@ -0,0 +1,96 @@
+package sshwrapper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Usage describes the resources used by a remote command.
+type Usage struct {
+	Wall   time.Duration
+	User   time.Duration
+	System time.Duration
+	MaxRSS int64 // maximum resident set size in bytes
+}
+
+const usageMarker = "sshwrapper-usage:"
+
+// RunTimed runs cmd like Run under GNU time (/usr/bin/time) and returns the resources it used.
+//
+// The standard error is written to errWriter only after the command completes,
+// with the report of time removed.
+func (s *SSHConn) RunTimed(cmd string, in io.Reader, outWriter, errWriter io.Writer) (*Usage, error) {
+	wrapped := `/usr/bin/time -f '` + usageMarker + ` %e %U %S %M' "${SHELL:-/bin/sh}" -c ` + shellQuote(cmd)
+
+	var stderr bytes.Buffer
+	err := s.Run(wrapped, in, outWriter, &stderr)
+
+	usage, rest, perr := stripUsage(stderr.String())
+	if perr != nil {
+		return nil, perr
+	}
+
+	if errWriter != nil {
+		if _, werr := io.WriteString(errWriter, rest); werr != nil && err == nil {
+			err = &WriterError{Stream: "stderr", Err: werr}
+		}
+	}
+	if usage == nil && err == nil {
+		err = fmt.Errorf("no resource usage reported, is GNU time installed?")
+	}
+	return usage, err
+}
+
+// stripUsage removes the report of time from the standard error of the command
+// and returns the usage it reports, or nil if there is none.
+func stripUsage(stderr string) (*Usage, string, error) {
+	lines := strings.SplitAfter(stderr, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(lines[i], usageMarker) {
+			continue
+		}
+		usage, err := parseUsage(lines[i])
+		if err != nil {
+			return nil, "", err
+		}
+		end := i + 1
+		// time reports a failed command on the preceding line
+		if i > 0 && strings.HasPrefix(lines[i-1], "Command ") {
+			i--
+		}
+		return usage, strings.Join(append(lines[:i], lines[end:]...), ""), nil
+	}
+	return nil, stderr, nil
+}
+
+// parseUsage parses the usage line printed by time.
+func parseUsage(line string) (*Usage, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, usageMarker))
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected time output: %q", line)
+	}
+
+	var secs [3]float64
+	for i := range secs {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected time output: %q", line)
+		}
+		secs[i] = v
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected time output: %q", line)
+	}
+
+	return &Usage{
+		Wall:   time.Duration(secs[0] * float64(time.Second)),
+		User:   time.Duration(secs[1] * float64(time.Second)),
+		System: time.Duration(secs[2] * float64(time.Second)),
+		MaxRSS: kb * 1024,
+	}, nil
+}
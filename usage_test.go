@@ -0,0 +1,71 @@
+package sshwrapper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUsage(t *testing.T) {
+	u, err := parseUsage(usageMarker + " 1.50 0.25 0.01 2048\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Usage{
+		Wall:   1500 * time.Millisecond,
+		User:   250 * time.Millisecond,
+		System: 10 * time.Millisecond,
+		MaxRSS: 2048 * 1024,
+	}
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("parseUsage = %+v, want %+v", u, want)
+	}
+
+	for _, line := range []string{
+		usageMarker + "\n",
+		usageMarker + " 1.50 0.25 0.01\n",
+		usageMarker + " 1.50 0.25 0.01 2048 7\n",
+		usageMarker + " 1.50 x 0.01 2048\n",
+		usageMarker + " 1.50 0.25 0.01 2.5\n",
+	} {
+		if _, err := parseUsage(line); err == nil {
+			t.Errorf("parseUsage(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestStripUsage(t *testing.T) {
+	report := usageMarker + " 0.00 0.00 0.00 1024\n"
+	tests := []struct {
+		name   string
+		stderr string
+		rest   string
+		found  bool
+	}{
+		{name: "only report", stderr: report, rest: "", found: true},
+		{name: "command stderr", stderr: "warning\n" + report, rest: "warning\n", found: true},
+		{name: "failed command", stderr: "error\nCommand exited with non-zero status 3\n" + report, rest: "error\n", found: true},
+		{name: "unterminated stderr", stderr: "partial" + report, rest: "partial" + report, found: false},
+		{name: "report printed by the command", stderr: report + "more\n" + report, rest: report + "more\n", found: true},
+		{name: "no report", stderr: "time: not found\n", rest: "time: not found\n", found: false},
+		{name: "empty", stderr: "", rest: "", found: false},
+	}
+
+	for _, tt := range tests {
+		usage, rest, err := stripUsage(tt.stderr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (usage != nil) != tt.found {
+			t.Errorf("%s: usage = %+v, want found %v", tt.name, usage, tt.found)
+		}
+		if rest != tt.rest {
+			t.Errorf("%s: rest = %q, want %q", tt.name, rest, tt.rest)
+		}
+	}
+
+	if _, _, err := stripUsage(usageMarker + " garbage\n"); err == nil {
+		t.Errorf("stripUsage of a malformed report succeeded, want error")
+	}
+}